@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// DaemonCheck is a single regression check run against a live candidate
+// daemon. Checks are gated by MinVersion so that a check exercising an API
+// that doesn't exist yet on older releases is skipped rather than failed.
+// Checks whose Default() returns false are only run when named explicitly
+// via --check.
+type DaemonCheck interface {
+	Name() string
+	MinVersion() string // empty means "supported since the beginning"
+	Default() bool
+	Run(tdir, bin string) error
+}
+
+// allChecks is the full set of checks TestBinary can run, in the order
+// they're executed. --check/--skip-check filter this list by Name().
+var allChecks = []DaemonCheck{
+	fileAddCheck{},
+	refsListCheck{},
+	gatewayCheck{},
+	pinningCheck{},
+	dagCheck{},
+	filesCheck{},
+	pubsubCheck{},
+}
+
+// selectChecks returns the subset of allChecks that should run for the given
+// target version, honoring an "only" allow-list and a "skip" deny-list
+// (either may be nil/empty, in which case it's not applied). An unknown name
+// in either list is an error, so typos in --check/--skip-check don't
+// silently no-op.
+func selectChecks(version string, only, skip []string) ([]DaemonCheck, error) {
+	byName := make(map[string]DaemonCheck, len(allChecks))
+	for _, c := range allChecks {
+		byName[c.Name()] = c
+	}
+
+	for _, n := range only {
+		if _, ok := byName[n]; !ok {
+			return nil, fmt.Errorf("unknown check %q", n)
+		}
+	}
+	for _, n := range skip {
+		if _, ok := byName[n]; !ok {
+			return nil, fmt.Errorf("unknown check %q", n)
+		}
+	}
+
+	onlySet := toSet(only)
+	skipSet := toSet(skip)
+
+	tv, err := ParseVersion(version)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing target version %q: %s", version, err)
+	}
+
+	var out []DaemonCheck
+	for _, c := range allChecks {
+		if len(onlySet) > 0 {
+			if !onlySet[c.Name()] {
+				continue
+			}
+		} else if !c.Default() {
+			continue
+		}
+		if skipSet[c.Name()] {
+			continue
+		}
+		if c.MinVersion() != "" {
+			min, err := ParseVersion(c.MinVersion())
+			if err != nil {
+				return nil, fmt.Errorf("error parsing min version for check %q: %s", c.Name(), err)
+			}
+			if tv.Less(min) {
+				continue
+			}
+		}
+		out = append(out, c)
+	}
+	return out, nil
+}
+
+func toSet(l []string) map[string]bool {
+	m := make(map[string]bool, len(l))
+	for _, s := range l {
+		m[s] = true
+	}
+	return m
+}
+
+// checksInclude reports whether a check named name is present in checks,
+// e.g. so the caller can decide whether to enable an experiment the check
+// depends on before starting the daemon.
+func checksInclude(checks []DaemonCheck, name string) bool {
+	for _, c := range checks {
+		if c.Name() == name {
+			return true
+		}
+	}
+	return false
+}
+
+type fileAddCheck struct{}
+
+func (fileAddCheck) Name() string       { return "file-add" }
+func (fileAddCheck) MinVersion() string { return "" }
+func (fileAddCheck) Default() bool      { return true }
+func (fileAddCheck) Run(tdir, bin string) error {
+	return testFileAdd(tdir, bin)
+}
+
+type refsListCheck struct{}
+
+func (refsListCheck) Name() string       { return "refs-list" }
+func (refsListCheck) MinVersion() string { return "" }
+func (refsListCheck) Default() bool      { return true }
+func (refsListCheck) Run(tdir, bin string) error {
+	return testRefsList(tdir, bin)
+}
+
+// gatewayCheck exercises the HTTP gateway by adding a file and then GETing
+// it back out over /ipfs/<cid>.
+type gatewayCheck struct{}
+
+func (gatewayCheck) Name() string       { return "gateway" }
+func (gatewayCheck) MinVersion() string { return "" }
+func (gatewayCheck) Default() bool      { return true }
+func (gatewayCheck) Run(tdir, bin string) error {
+	text := "hello from the gateway check"
+	hash, err := addString(tdir, bin, text)
+	if err != nil {
+		return err
+	}
+
+	gwAddr, err := gatewayAddr(tdir)
+	if err != nil {
+		return fmt.Errorf("error finding gateway address: %s", err)
+	}
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/ipfs/%s", gwAddr, hash))
+	if err != nil {
+		return fmt.Errorf("error fetching from gateway: %s", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if string(body) != text {
+		return fmt.Errorf("gateway returned unexpected body for %s", hash)
+	}
+	return nil
+}
+
+// pubsubCheck subscribes to a topic in the background, publishes to it, and
+// checks the message comes back out.
+type pubsubCheck struct{}
+
+func (pubsubCheck) Name() string       { return "pubsub" }
+func (pubsubCheck) MinVersion() string { return "v0.4.5" }
+
+// Default is true: whenever this check is selected, StartDaemon is told to
+// pass --enable-pubsub-experiment to the candidate daemon, so it runs like
+// any other check on versions that support it (gated by MinVersion above).
+func (pubsubCheck) Default() bool { return true }
+func (pubsubCheck) Run(tdir, bin string) error {
+	topic := "ipfs-update-check"
+
+	sub := exec.Command(bin, "pubsub", "sub", topic)
+	sub.Env = []string{"IPFS_PATH=" + tdir}
+	stdout, err := sub.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("error opening pubsub subscriber stdout: %s", err)
+	}
+	if err := sub.Start(); err != nil {
+		return fmt.Errorf("error starting pubsub subscriber: %s", err)
+	}
+	defer sub.Process.Kill()
+
+	// a single goroutine owns the pipe and hands lines off over a channel,
+	// so nothing reads the subscriber's output concurrently with it
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+
+	// give the subscription time to propagate before publishing
+	time.Sleep(500 * time.Millisecond)
+
+	msg := "hello pubsub"
+	if _, err := runCmd(tdir, bin, "pubsub", "pub", topic, msg); err != nil {
+		return fmt.Errorf("error publishing: %s", err)
+	}
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				return fmt.Errorf("subscriber exited before seeing the published message")
+			}
+			if strings.Contains(line, msg) {
+				return nil
+			}
+		case <-timeout:
+			return fmt.Errorf("subscriber never saw published message")
+		}
+	}
+}
+
+// pinningCheck exercises pin add / pin ls / pin rm.
+type pinningCheck struct{}
+
+func (pinningCheck) Name() string       { return "pinning" }
+func (pinningCheck) MinVersion() string { return "" }
+func (pinningCheck) Default() bool      { return true }
+func (pinningCheck) Run(tdir, bin string) error {
+	hash, err := addString(tdir, bin, "hello from the pinning check")
+	if err != nil {
+		return err
+	}
+
+	if _, err := runCmd(tdir, bin, "pin", "add", hash); err != nil {
+		return fmt.Errorf("error pinning %s: %s", hash, err)
+	}
+
+	out, err := runCmd(tdir, bin, "pin", "ls", "--type=recursive")
+	if err != nil {
+		return fmt.Errorf("error listing pins: %s", err)
+	}
+	if !strings.Contains(out, hash) {
+		return fmt.Errorf("expected %s in recursive pin list", hash)
+	}
+
+	if _, err := runCmd(tdir, bin, "pin", "rm", hash); err != nil {
+		return fmt.Errorf("error removing pin %s: %s", hash, err)
+	}
+
+	return nil
+}
+
+// dagCheck round-trips a small CBOR document through `dag put`/`dag get`.
+type dagCheck struct{}
+
+func (dagCheck) Name() string       { return "dag" }
+func (dagCheck) MinVersion() string { return "v0.4.5" }
+func (dagCheck) Default() bool      { return true }
+func (dagCheck) Run(tdir, bin string) error {
+	doc := `{"hello":"world"}`
+
+	c := exec.Command(bin, "dag", "put")
+	c.Env = []string{"IPFS_PATH=" + tdir}
+	c.Stdin = strings.NewReader(doc)
+	out, err := c.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("error putting dag node: %s: %s", err, string(out))
+	}
+	hash := strings.Trim(string(out), "\n \t")
+
+	got, err := runCmd(tdir, bin, "dag", "get", hash)
+	if err != nil {
+		return fmt.Errorf("error getting dag node: %s", err)
+	}
+
+	if !strings.Contains(got, "world") {
+		return fmt.Errorf("dag get of %s did not round-trip the document", hash)
+	}
+
+	return nil
+}
+
+// filesCheck exercises the MFS files API: mkdir, write, stat.
+type filesCheck struct{}
+
+func (filesCheck) Name() string       { return "files" }
+func (filesCheck) MinVersion() string { return "" }
+func (filesCheck) Default() bool      { return true }
+func (filesCheck) Run(tdir, bin string) error {
+	if _, err := runCmd(tdir, bin, "files", "mkdir", "/check-dir"); err != nil {
+		return fmt.Errorf("error making mfs dir: %s", err)
+	}
+
+	c := exec.Command(bin, "files", "write", "--create", "/check-dir/hello.txt")
+	c.Env = []string{"IPFS_PATH=" + tdir}
+	c.Stdin = strings.NewReader("hello from the files check")
+	out, err := c.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("error writing mfs file: %s: %s", err, string(out))
+	}
+
+	if _, err := runCmd(tdir, bin, "files", "stat", "/check-dir/hello.txt"); err != nil {
+		return fmt.Errorf("error stating mfs file: %s", err)
+	}
+
+	return nil
+}
+
+func addString(tdir, bin, text string) (string, error) {
+	c := exec.Command(bin, "add", "-q")
+	c.Env = []string{"IPFS_PATH=" + tdir}
+	c.Stdin = strings.NewReader(text)
+	out, err := c.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("error adding file: %s: %s", err, string(out))
+	}
+	return strings.Trim(string(out), "\n \t"), nil
+}
+
+var gatewayListenRe = regexp.MustCompile(`Gateway.*listening on .*/tcp/(\d+)`)
+
+// gatewayAddr finds the port the daemon's gateway ended up bound to by
+// scraping its stdout log, since the gateway port is randomized the same
+// way the API port is. waitForApi only guarantees the API is up by the time
+// this runs, not that the gateway has logged its listen line yet, so this
+// polls the same way waitForApi does rather than assuming the line is
+// already there.
+func gatewayAddr(tdir string) (string, error) {
+	logPath := filepath.Join(tdir, "daemon.stdout")
+	nloops := 15
+	for i := 0; i < nloops; i++ {
+		data, err := ioutil.ReadFile(logPath)
+		if err != nil {
+			return "", err
+		}
+
+		if m := gatewayListenRe.FindSubmatch(data); m != nil {
+			return "127.0.0.1:" + string(m[1]), nil
+		}
+
+		time.Sleep(time.Millisecond * (100 * time.Duration(i+1)))
+	}
+
+	return "", fmt.Errorf("no gateway listen address found in daemon output")
+}
@@ -0,0 +1,286 @@
+// Package migrations downloads and runs the individual fs-repo-N-to-M-migration
+// binaries needed to bring an ipfs repo from one repo version to another,
+// without requiring the user to have the monolithic fs-repo-migrations tool
+// on their PATH.
+package migrations
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+
+	stump "github.com/whyrusleeping/stump"
+)
+
+const (
+	distPath    = "https://dist.ipfs.io"
+	gatewayPath = "https://ipfs.io/ipns/dist.ipfs.io"
+)
+
+// binDir returns the directory individual migration binaries are cached in;
+// fetchMigration downloads each one into it the first time it's needed.
+func binDir(ipfsDir string) string {
+	return filepath.Join(ipfsDir, "migration-bin")
+}
+
+// migrationName returns the name of the migration binary that moves a repo
+// from version n to n+1, e.g. "fs-repo-8-to-9-migration".
+func migrationName(n int) string {
+	return fmt.Sprintf("fs-repo-%d-to-%d-migration", n, n+1)
+}
+
+// planMigrations computes the ordered list of migration names needed to get
+// from oldRepoVer to newRepoVer. If newRepoVer is less than oldRepoVer, the
+// list is returned in reverse (newest-first) order, for use with -revert.
+func planMigrations(oldRepoVer, newRepoVer int) []string {
+	var names []string
+	if oldRepoVer < newRepoVer {
+		for n := oldRepoVer; n < newRepoVer; n++ {
+			names = append(names, migrationName(n))
+		}
+		return names
+	}
+
+	for n := oldRepoVer; n > newRepoVer; n-- {
+		names = append(names, migrationName(n-1))
+	}
+	return names
+}
+
+// RunMigrations brings the repo at ipfsPath from oldRepoVer to newRepoVer,
+// downloading (and caching under ipfsDir/migration-bin) and invoking each
+// intermediate migration binary in order. verbose is passed through to each
+// migration binary's -verbose flag.
+func RunMigrations(ipfsDir, ipfsPath string, oldRepoVer, newRepoVer int, verbose bool) error {
+	if oldRepoVer == newRepoVer {
+		return nil
+	}
+
+	revert := newRepoVer < oldRepoVer
+	names := planMigrations(oldRepoVer, newRepoVer)
+
+	cacheDir := binDir(ipfsDir)
+	err := os.MkdirAll(cacheDir, 0755)
+	if err != nil {
+		return fmt.Errorf("error creating migration cache directory: %s", err)
+	}
+
+	for _, name := range names {
+		stump.Log("running migration %s", name)
+		binPath, err := fetchMigration(cacheDir, name)
+		if err != nil {
+			return fmt.Errorf("error fetching %s: %s", name, err)
+		}
+
+		err = runMigration(binPath, ipfsPath, revert, verbose)
+		if err != nil {
+			return fmt.Errorf("error running %s: %s", name, err)
+		}
+	}
+
+	return nil
+}
+
+// fetchMigration returns the path to a cached, executable copy of the named
+// migration binary, downloading and unpacking it first if it isn't already
+// in cacheDir.
+func fetchMigration(cacheDir, name string) (string, error) {
+	binName := binaryName(name)
+	binPath := filepath.Join(cacheDir, binName)
+	if _, err := os.Stat(binPath); err == nil {
+		return binPath, nil
+	}
+
+	archiveName := fmt.Sprintf("%s_%s-%s.%s", name, runtime.GOOS, runtime.GOARCH, archiveExt())
+	data, err := fetchArchive(name, archiveName)
+	if err != nil {
+		return "", err
+	}
+
+	err = unpackBinary(data, binName, binPath)
+	if err != nil {
+		return "", err
+	}
+
+	err = os.Chmod(binPath, 0755)
+	if err != nil {
+		return "", err
+	}
+
+	return binPath, nil
+}
+
+// archiveExt returns the distribution archive extension for the current
+// platform: dist.ipfs.io ships Windows builds as .zip and everything else
+// as .tar.gz.
+func archiveExt() string {
+	if runtime.GOOS == "windows" {
+		return "zip"
+	}
+	return "tar.gz"
+}
+
+// binaryName returns the filename a migration binary is packaged under on
+// the current platform, e.g. "fs-repo-8-to-9-migration.exe" on Windows.
+func binaryName(name string) string {
+	if runtime.GOOS == "windows" {
+		return name + ".exe"
+	}
+	return name
+}
+
+// fetchArchive downloads the distribution archive for a migration binary,
+// preferring dist.ipfs.io and falling back to the ipfs.io gateway (mirroring
+// the fallback behavior used to fetch the ipfs binary itself).
+func fetchArchive(name, archiveName string) ([]byte, error) {
+	url := fmt.Sprintf("%s/%s/versions", distPath, name)
+	versions, err := httpGet(url)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching versions for %s: %s", name, err)
+	}
+	latest := lastLine(versions)
+	if latest == "" {
+		return nil, fmt.Errorf("no published versions found for %s", name)
+	}
+
+	path := fmt.Sprintf("%s/%s/%s/%s", distPath, name, latest, archiveName)
+	data, err := httpGet(path)
+	if err != nil {
+		path = fmt.Sprintf("%s/%s/%s/%s", gatewayPath, name, latest, archiveName)
+		stump.VLog("  - failed to fetch directly, trying gateway fallback: %s", path)
+		data, err = httpGet(path)
+		if err != nil {
+			return nil, fmt.Errorf("error fetching %s from dist and gateway: %s", archiveName, err)
+		}
+	}
+
+	sum := sha512.Sum512(data)
+	expected, err := httpGet(path + ".sha512")
+	if err != nil {
+		return nil, fmt.Errorf("error fetching checksum for %s: %s", archiveName, err)
+	}
+
+	if hex.EncodeToString(sum[:]) != firstField(string(expected)) {
+		return nil, fmt.Errorf("checksum mismatch for %s", archiveName)
+	}
+
+	return data, nil
+}
+
+func httpGet(url string) ([]byte, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+// unpackBinary extracts the named executable out of a downloaded archive
+// and writes it to dest. The archive format follows the platform
+// convention used by dist.ipfs.io: a gzipped tarball everywhere except
+// Windows, which ships a zip.
+func unpackBinary(archive []byte, name, dest string) error {
+	if runtime.GOOS == "windows" {
+		return unpackZip(archive, name, dest)
+	}
+	return unpackTarGz(archive, name, dest)
+}
+
+func unpackTarGz(archive []byte, name, dest string) error {
+	gr, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		return err
+	}
+	defer gr.Close()
+
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return fmt.Errorf("%s not found in archive", name)
+		}
+		if err != nil {
+			return err
+		}
+
+		if filepath.Base(hdr.Name) != name {
+			continue
+		}
+
+		out, err := os.Create(dest)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+
+		_, err = io.Copy(out, tr)
+		return err
+	}
+}
+
+func unpackZip(archive []byte, name, dest string) error {
+	zr, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		return err
+	}
+
+	for _, f := range zr.File {
+		if filepath.Base(f.Name) != name {
+			continue
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+
+		out, err := os.Create(dest)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+
+		_, err = io.Copy(out, rc)
+		return err
+	}
+
+	return fmt.Errorf("%s not found in archive", name)
+}
+
+// runMigration invokes a cached migration binary against the given repo,
+// with -revert and -verbose set as appropriate.
+func runMigration(binPath, ipfsPath string, revert, verbose bool) error {
+	args := []string{"-path=" + ipfsPath}
+	if revert {
+		args = append(args, "-revert")
+	}
+	if verbose {
+		args = append(args, "-verbose")
+	}
+
+	cmd := exec.Command(binPath, args...)
+	cmd.Env = []string{"IPFS_PATH=" + ipfsPath}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, string(out))
+	}
+	return nil
+}
@@ -0,0 +1,25 @@
+package migrations
+
+import (
+	"strings"
+)
+
+// lastLine returns the last non-empty line of a newline-separated byte
+// slice, used to pick the most recent entry out of a dist "versions" file.
+func lastLine(b []byte) string {
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+// firstField returns the first whitespace-separated field of s, used to
+// pull the hex digest out of a "<digest>  <filename>" style checksum file.
+func firstField(s string) string {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[0]
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	homedir "github.com/mitchellh/go-homedir"
+	stump "github.com/whyrusleeping/stump"
+)
+
+// pluginLoadErrorPrefixes are the well-known prefixes go-ipfs writes to
+// stderr when a .so plugin fails to load, most commonly because it was
+// built against a different go-ipfs/go-plugin ABI than the candidate
+// binary.
+var pluginLoadErrorPrefixes = []string{
+	"error loading plugin",
+	"plugin was built with a different version",
+}
+
+// PluginLoadError is returned by TestBinaryChecks when the candidate
+// daemon's log shows a plugin failing to load, naming the offending file so
+// the user knows what to rebuild or remove.
+type PluginLoadError struct {
+	Plugin  string
+	Message string
+}
+
+func (e *PluginLoadError) Error() string {
+	return fmt.Sprintf("plugin %s failed to load: %s", e.Plugin, e.Message)
+}
+
+// userIPFSPath returns the real, already-installed ipfs repo path (as
+// opposed to ipfsDir(), which is where ipfs-update keeps its own state),
+// honoring $IPFS_PATH the same way ipfs itself does and falling back to
+// ~/.ipfs.
+func userIPFSPath() (string, error) {
+	if p := os.Getenv("IPFS_PATH"); p != "" {
+		return p, nil
+	}
+
+	home, err := homedir.Dir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".ipfs"), nil
+}
+
+// preservePlugins makes the user's installed plugins visible to the
+// candidate daemon running out of the staging directory tdir, so upgrades
+// get tested against the plugins that are actually in use. It's a no-op if
+// the user has no plugins/ directory.
+func preservePlugins(tdir string) error {
+	realPath, err := userIPFSPath()
+	if err != nil {
+		return err
+	}
+
+	src := filepath.Join(realPath, "plugins")
+	if _, err := os.Stat(src); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	dst := filepath.Join(tdir, "plugins")
+	stump.VLog("  - carrying installed plugins from %s into test repo", src)
+
+	err = os.Symlink(src, dst)
+	if err == nil {
+		return nil
+	}
+
+	stump.VLog("  - symlinking plugins failed (%s), falling back to copying", err)
+	return copyDir(src, dst)
+}
+
+func copyDir(src, dst string) error {
+	entries, err := ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		srcPath := filepath.Join(src, entry.Name())
+		dstPath := filepath.Join(dst, entry.Name())
+
+		if entry.IsDir() {
+			if err := copyDir(srcPath, dstPath); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := copyFile(srcPath, dstPath); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode())
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, in)
+	return err
+}
+
+// checkPluginLoadErrors scans the candidate daemon's stderr log for the
+// well-known plugin-load failure prefixes. If ignoreErrors is set, a
+// matching line is logged but not treated as fatal.
+func checkPluginLoadErrors(tdir string, ignoreErrors bool) error {
+	f, err := os.Open(filepath.Join(tdir, "daemon.stderr"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		for _, prefix := range pluginLoadErrorPrefixes {
+			if !strings.Contains(line, prefix) {
+				continue
+			}
+
+			if ignoreErrors {
+				stump.Log("== ignoring plugin load error (--ignore-plugin-errors): %s ==", line)
+				continue
+			}
+
+			return &PluginLoadError{
+				Plugin:  pluginFileFromLogLine(line),
+				Message: line,
+			}
+		}
+	}
+
+	return scanner.Err()
+}
+
+// pluginFileFromLogLine does a best-effort extraction of the plugin's .so
+// path out of a go-ipfs plugin-load error line.
+func pluginFileFromLogLine(line string) string {
+	fields := strings.Fields(line)
+	for _, f := range fields {
+		if strings.HasSuffix(f, ".so") {
+			return f
+		}
+	}
+	return "unknown"
+}
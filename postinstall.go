@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/songjiayang/ipfs-update/migrations"
+	stump "github.com/whyrusleeping/stump"
+)
+
+// Install tests newBin per opts, swaps it in for the binary at installPath,
+// and migrates the repo at ipfsPath to the version newBin expects. It is
+// the minimal, self-contained version of the install flow this chunk can
+// own: the full `install` command (outside this chunk) is expected to grow
+// around this call, adding things like a backup of the replaced binary, but
+// Install is already usable as-is, and is what makes RunRepoMigrations
+// reachable rather than dead code.
+func Install(newBin, installPath, ipfsPath, version string, opts TestBinaryOptions) error {
+	if err := TestBinaryWithOptions(newBin, version, opts); err != nil {
+		return fmt.Errorf("binary failed testing: %s", err)
+	}
+
+	if err := installBinary(newBin, installPath); err != nil {
+		return fmt.Errorf("error installing new binary: %s", err)
+	}
+
+	if err := RunRepoMigrations(newBin, ipfsPath, false); err != nil {
+		return fmt.Errorf("error migrating repo: %s", err)
+	}
+
+	return nil
+}
+
+// installBinary copies newBin over installPath and makes it executable. It
+// intentionally doesn't back up the replaced binary; that belongs to the
+// full `install` command this chunk doesn't own.
+func installBinary(newBin, installPath string) error {
+	data, err := ioutil.ReadFile(newBin)
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(installPath, data, 0755); err != nil {
+		return err
+	}
+
+	return os.Chmod(installPath, 0755)
+}
+
+// RunRepoMigrations brings the repo at ipfsPath up (or down) to the version
+// expected by newBin, if it isn't already there. Install calls it right
+// after installBinary succeeds and before reporting success, so a failed
+// migration still leaves the user able to retry against a known-good
+// binary.
+func RunRepoMigrations(newBin, ipfsPath string, verbose bool) error {
+	curVer, err := onDiskRepoVersion(ipfsPath)
+	if err != nil {
+		return fmt.Errorf("error reading current repo version: %s", err)
+	}
+
+	newVer, err := binaryRepoVersion(newBin)
+	if err != nil {
+		return fmt.Errorf("error checking new binary's repo version: %s", err)
+	}
+
+	if curVer == newVer {
+		return nil
+	}
+
+	stump.Log("repo version %d does not match binary's expected version %d, running migrations", curVer, newVer)
+	return migrations.RunMigrations(ipfsDir(), ipfsPath, curVer, newVer, verbose)
+}
+
+// onDiskRepoVersion reads the repo version out of <IPFS_PATH>/version.
+func onDiskRepoVersion(ipfsPath string) (int, error) {
+	data, err := ioutil.ReadFile(filepath.Join(ipfsPath, "version"))
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+// binaryRepoVersion runs `<bin> repo version --quiet` against a scratch repo
+// to find out which repo version a candidate binary expects.
+func binaryRepoVersion(bin string) (int, error) {
+	scratch, err := ioutil.TempDir("", "ipfs-update-repover")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(scratch)
+
+	cmd := exec.Command(bin, "repo", "version", "--quiet")
+	cmd.Env = []string{"IPFS_PATH=" + scratch}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %s", err, string(out))
+	}
+
+	return strconv.Atoi(strings.TrimSpace(string(out)))
+}
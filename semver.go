@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Version is a parsed semver 2.0 version: MAJOR.MINOR.PATCH[-PRERELEASE][+BUILD].
+// Build metadata is intentionally not kept around since it has no bearing on
+// precedence.
+type Version struct {
+	Major, Minor, Patch int
+	Pre                 []string
+}
+
+// ParseVersion parses a version string of the form "vMAJOR.MINOR.PATCH",
+// "MAJOR.MINOR.PATCH", optionally followed by "-PRERELEASE" and/or
+// "+BUILD". Build metadata is parsed but discarded.
+func ParseVersion(s string) (Version, error) {
+	s = strings.TrimPrefix(s, "v")
+
+	if i := strings.IndexByte(s, '+'); i >= 0 {
+		s = s[:i]
+	}
+
+	var pre []string
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		pre = strings.Split(s[i+1:], ".")
+		s = s[:i]
+	}
+
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return Version{}, fmt.Errorf("invalid version %q: expected MAJOR.MINOR.PATCH", s)
+	}
+
+	nums := make([]int, 3)
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return Version{}, fmt.Errorf("invalid version %q: %s", s, err)
+		}
+		nums[i] = n
+	}
+
+	return Version{Major: nums[0], Minor: nums[1], Patch: nums[2], Pre: pre}, nil
+}
+
+// Equal reports whether v and o denote the same version, ignoring build
+// metadata (which was never kept in the first place).
+func (v Version) Equal(o Version) bool {
+	return !v.Less(o) && !o.Less(v)
+}
+
+// Less reports whether v sorts before o per semver 2.0 precedence rules: a
+// pre-release version has lower precedence than the associated normal
+// version, and pre-release identifiers are compared left to right, with
+// all-numeric identifiers compared numerically and the rest lexically. A
+// version with a pre-release identifier list that is a prefix of another's
+// sorts first.
+func (v Version) Less(o Version) bool {
+	if v.Major != o.Major {
+		return v.Major < o.Major
+	}
+	if v.Minor != o.Minor {
+		return v.Minor < o.Minor
+	}
+	if v.Patch != o.Patch {
+		return v.Patch < o.Patch
+	}
+
+	if len(v.Pre) == 0 && len(o.Pre) == 0 {
+		return false
+	}
+	if len(v.Pre) == 0 {
+		return false // v is a release, o is a pre-release: v is greater
+	}
+	if len(o.Pre) == 0 {
+		return true // v is a pre-release, o is a release: v is lesser
+	}
+
+	for i := 0; i < len(v.Pre) && i < len(o.Pre); i++ {
+		a, b := v.Pre[i], o.Pre[i]
+		if a == b {
+			continue
+		}
+
+		an, aerr := strconv.Atoi(a)
+		bn, berr := strconv.Atoi(b)
+		if aerr == nil && berr == nil {
+			return an < bn
+		}
+		if aerr == nil {
+			return true // numeric identifiers sort before non-numeric ones
+		}
+		if berr == nil {
+			return false
+		}
+		return a < b
+	}
+
+	return len(v.Pre) < len(o.Pre)
+}
+
+// beforeVersion reports whether cur is a strictly earlier version than
+// check, both given as "vMAJOR.MINOR.PATCH[-PRE]" strings. Unparseable
+// versions are treated as not-before, same as the old Atoi-based behavior.
+func beforeVersion(check, cur string) bool {
+	a, err := ParseVersion(check)
+	if err != nil {
+		return false
+	}
+	b, err := ParseVersion(cur)
+	if err != nil {
+		return false
+	}
+	return b.Less(a)
+}
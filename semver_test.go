@@ -0,0 +1,48 @@
+package main
+
+import "testing"
+
+func TestVersionLess(t *testing.T) {
+	cases := []struct {
+		a, b string
+		less bool
+	}{
+		{"v0.3.8-rc1", "v0.3.8", true},
+		{"v0.3.8", "v0.3.8-rc1", false},
+		{"v0.9.0", "v0.10.0", true},
+		{"v0.10.0", "v0.9.0", false},
+		{"v0.4.0", "v0.4.0", false},
+		{"v0.4.0-rc1", "v0.4.0-rc2", true},
+		{"v0.4.0-rc2", "v0.4.0-rc1", false},
+	}
+
+	for _, c := range cases {
+		va, err := ParseVersion(c.a)
+		if err != nil {
+			t.Fatalf("parsing %q: %s", c.a, err)
+		}
+		vb, err := ParseVersion(c.b)
+		if err != nil {
+			t.Fatalf("parsing %q: %s", c.b, err)
+		}
+
+		if got := va.Less(vb); got != c.less {
+			t.Errorf("Less(%q, %q) = %v, want %v", c.a, c.b, got, c.less)
+		}
+	}
+}
+
+func TestVersionEqual(t *testing.T) {
+	va, err := ParseVersion("v0.4.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vb, err := ParseVersion("0.4.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !va.Equal(vb) {
+		t.Errorf("expected %v to equal %v", va, vb)
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	stump "github.com/whyrusleeping/stump"
+)
+
+// clusterDaemon bundles a single node's daemon process together with the
+// staging directory it was started in, so teardown can address both.
+type clusterDaemon struct {
+	dir string
+	d   io.Closer
+}
+
+// idOutput mirrors the fields we care about from `ipfs id`.
+type idOutput struct {
+	ID        string
+	Addresses []string
+}
+
+// TestBinaryCluster provisions n sandboxed ipfs nodes under
+// ipfsDir()/update-staging/cluster-XXXX/{0..n-1}, wires them together over
+// swarm, and checks that a block added on node 0 can be cat'ed from node
+// n-1 and that `dht findprovs` on one other node (node 1, or node n-1 when
+// n is 2) lists node 0 as a provider. It is invoked when
+// `--cluster-check` is passed to `install`, as a deeper alternative to the
+// single-node checks in TestBinary.
+func TestBinaryCluster(bin, version string, n int) error {
+	if n < 2 {
+		return fmt.Errorf("cluster check requires at least 2 nodes, got %d", n)
+	}
+
+	if beforeVersion("v0.3.8", version) {
+		stump.Log("== skipping cluster check, versions before 0.3.8 do not support port zero ==")
+		return nil
+	}
+
+	err := os.Chmod(bin, 0755)
+	if err != nil {
+		return err
+	}
+
+	staging := filepath.Join(ipfsDir(), "update-staging")
+	err = os.MkdirAll(staging, 0755)
+	if err != nil {
+		return fmt.Errorf("error creating test staging directory: %s", err)
+	}
+
+	cdir, err := ioutil.TempDir(staging, "cluster-")
+	if err != nil {
+		return err
+	}
+
+	var daemons []*clusterDaemon
+	defer func() {
+		stump.VLog("  - tearing down cluster of %d nodes", len(daemons))
+		for _, cd := range daemons {
+			if cd.d != nil {
+				if err := cd.d.Close(); err != nil {
+					stump.Error("error killing cluster node: %s", err)
+				}
+			}
+		}
+		if err := os.RemoveAll(cdir); err != nil {
+			stump.Error("error cleaning up cluster staging directory: %s", err)
+		}
+	}()
+
+	nodeDirs := make([]string, n)
+	for i := 0; i < n; i++ {
+		nodeDirs[i] = filepath.Join(cdir, fmt.Sprintf("%d", i))
+		err = os.MkdirAll(nodeDirs[i], 0755)
+		if err != nil {
+			return fmt.Errorf("error creating node %d staging directory: %s", i, err)
+		}
+
+		stump.VLog("  - running init for cluster node %d", i)
+		_, err = runCmd(nodeDirs[i], bin, "init")
+		if err != nil {
+			return fmt.Errorf("error initializing cluster node %d: %s", i, err)
+		}
+
+		err = tweakConfig(nodeDirs[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	ids := make([]idOutput, n)
+	for i, dir := range nodeDirs {
+		stump.VLog("  - starting daemon for cluster node %d", i)
+		d, err := StartDaemon(dir, bin, false)
+		if err != nil {
+			return fmt.Errorf("error starting cluster node %d: %s", i, err)
+		}
+		daemons = append(daemons, &clusterDaemon{dir: dir, d: d})
+
+		idout, err := runCmd(dir, bin, "id")
+		if err != nil {
+			return fmt.Errorf("error fetching id for cluster node %d: %s", i, err)
+		}
+
+		err = json.Unmarshal([]byte(idout), &ids[i])
+		if err != nil {
+			return fmt.Errorf("error parsing id for cluster node %d: %s", i, err)
+		}
+	}
+
+	stump.VLog("  - connecting %d cluster nodes over swarm", n)
+	for i := 1; i < n; i++ {
+		addr := firstDialableAddr(ids[0])
+		if addr == "" {
+			return fmt.Errorf("node 0 reported no dialable addresses")
+		}
+
+		_, err = runCmd(nodeDirs[i], bin, "swarm", "connect", addr)
+		if err != nil {
+			return fmt.Errorf("error connecting node %d to node 0: %s", i, err)
+		}
+	}
+
+	text := "hello from the cluster smoke test"
+	c := exec.Command(bin, "add", "-q")
+	c.Env = []string{"IPFS_PATH=" + nodeDirs[0]}
+	c.Stdin = strings.NewReader(text)
+	out, err := c.CombinedOutput()
+	if err != nil {
+		stump.Error(string(out))
+		return fmt.Errorf("error adding block on node 0: %s", err)
+	}
+	hash := strings.Trim(string(out), "\n \t")
+
+	last := n - 1
+	stump.VLog("  - catting block added on node 0 from node %d", last)
+	catOut, err := runCmd(nodeDirs[last], bin, "cat", hash)
+	if err != nil {
+		return fmt.Errorf("error catting block from node %d: %s", last, err)
+	}
+	if catOut != text {
+		return fmt.Errorf("block fetched from node %d did not match what was added on node 0", last)
+	}
+
+	var findprovNode int
+	if n > 2 {
+		findprovNode = 1
+	} else {
+		findprovNode = last
+	}
+
+	stump.VLog("  - checking dht findprovs for the block on node %d", findprovNode)
+	err = waitForProvider(nodeDirs[findprovNode], bin, hash, ids[0].ID)
+	if err != nil {
+		return fmt.Errorf("node %d never saw node 0 (%s) as a provider of %s: %s", findprovNode, ids[0].ID, hash, err)
+	}
+
+	stump.Log("cluster check passed with %d nodes", n)
+	return nil
+}
+
+// waitForProvider polls `dht findprovs` on dir until providerID shows up as
+// a provider of hash, giving up after a few rounds. Provider announcement
+// after `add` is asynchronous, so checking just once (like waitForApi would
+// if it didn't retry) is flaky under any load.
+func waitForProvider(dir, bin, hash, providerID string) error {
+	nloops := 15
+	var lastErr error
+	for i := 0; i < nloops; i++ {
+		provsOut, err := runCmd(dir, bin, "dht", "findprovs", hash)
+		if err != nil {
+			lastErr = fmt.Errorf("error running dht findprovs: %s", err)
+		} else {
+			lastErr = nil
+			for _, line := range strings.Split(provsOut, "\n") {
+				if line == providerID {
+					return nil
+				}
+			}
+		}
+
+		time.Sleep(time.Millisecond * (200 * time.Duration(i+1)))
+	}
+
+	if lastErr != nil {
+		return lastErr
+	}
+	return fmt.Errorf("did not show up as a provider")
+}
+
+// firstDialableAddr picks a swarm address to dial, preferring a loopback
+// (127.0.0.1) entry since every cluster node runs on the same host and a
+// 127.0.0.1 address is always reachable between them, falling back to
+// whatever was reported first if no loopback address shows up.
+func firstDialableAddr(id idOutput) string {
+	var fallback string
+	for _, a := range id.Addresses {
+		if fallback == "" {
+			fallback = a
+		}
+		if strings.Contains(a, "127.0.0.1") {
+			return a
+		}
+	}
+	return fallback
+}
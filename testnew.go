@@ -10,7 +10,6 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"time"
 
@@ -25,6 +24,10 @@ func runCmd(p, bin string, args ...string) (string, error) {
 		return "", fmt.Errorf("%s: %s", err, string(out))
 	}
 
+	if len(out) == 0 {
+		return "", nil
+	}
+
 	if out[len(out)-1] == '\n' {
 		return string(out[:len(out)-1]), nil
 	}
@@ -76,7 +79,7 @@ func tweakConfig(ipfspath string) error {
 	}
 
 	addrs["API"] = "/ip4/127.0.0.1/tcp/0"
-	addrs["Gateway"] = ""
+	addrs["Gateway"] = "/ip4/127.0.0.1/tcp/0"
 	addrs["Swarm"] = []string{"/ip4/0.0.0.0/tcp/0"}
 
 	out, err := json.Marshal(cfg)
@@ -92,8 +95,12 @@ func tweakConfig(ipfspath string) error {
 	return nil
 }
 
-func StartDaemon(p, bin string) (io.Closer, error) {
-	cmd := exec.Command(bin, "daemon")
+func StartDaemon(p, bin string, enablePubsub bool) (*daemon, error) {
+	args := []string{"daemon"}
+	if enablePubsub {
+		args = append(args, "--enable-pubsub-experiment")
+	}
+	cmd := exec.Command(bin, args...)
 
 	stdout, err := os.Create(filepath.Join(p, "daemon.stdout"))
 	if err != nil {
@@ -169,7 +176,57 @@ func waitForApi(ipfspath string) error {
 	return fmt.Errorf("failed to come online")
 }
 
+// TestBinaryOptions configures a TestBinary run. The zero value reproduces
+// the historical behavior: the default check set against a single daemon.
+// It exists so the `install` command has a single struct to populate from
+// its flags and pass through, rather than threading each flag into its own
+// parameter.
+type TestBinaryOptions struct {
+	// ClusterCheck runs TestBinaryCluster instead of the single-daemon
+	// checks, from --cluster-check. ClusterSize is the number of nodes to
+	// provision; it defaults to 3 when ClusterCheck is set and ClusterSize
+	// is left at 0.
+	ClusterCheck bool
+	ClusterSize  int
+
+	// Only and Skip filter the check set run against a single daemon, from
+	// --check and --skip-check respectively; either may be nil.
+	Only, Skip []string
+
+	// IgnorePluginErrors downgrades a plugin-load failure in the candidate
+	// daemon from fatal to logged, from --ignore-plugin-errors.
+	IgnorePluginErrors bool
+}
+
+// TestBinary runs the default check set (everything supported by version)
+// against the candidate binary. Use TestBinaryChecks to restrict or exclude
+// specific checks via --check/--skip-check, or TestBinaryWithOptions for
+// --cluster-check.
 func TestBinary(bin, version string) error {
+	return TestBinaryWithOptions(bin, version, TestBinaryOptions{})
+}
+
+// TestBinaryWithOptions is the entry point the `install` command calls,
+// passing through --cluster-check, --check/--skip-check, and
+// --ignore-plugin-errors as set on opts.
+func TestBinaryWithOptions(bin, version string, opts TestBinaryOptions) error {
+	if opts.ClusterCheck {
+		size := opts.ClusterSize
+		if size == 0 {
+			size = 3
+		}
+		return TestBinaryCluster(bin, version, size)
+	}
+	return TestBinaryChecks(bin, version, opts.Only, opts.Skip, opts.IgnorePluginErrors)
+}
+
+// TestBinaryChecks runs the checks selected by only/skip (either may be nil
+// to mean "don't filter") against the candidate binary. only, if non-empty,
+// restricts the run to exactly those checks; skip excludes checks from
+// whatever set would otherwise run. ignorePluginErrors controls whether a
+// plugin failing to load in the candidate daemon aborts the check (the
+// default) or is merely logged, per --ignore-plugin-errors.
+func TestBinaryChecks(bin, version string, only, skip []string, ignorePluginErrors bool) error {
 	// make sure binary is executable
 	err := os.Chmod(bin, 0755)
 	if err != nil {
@@ -221,6 +278,11 @@ func TestBinary(bin, version string) error {
 		return nil
 	}
 
+	checks, err := selectChecks(version, only, skip)
+	if err != nil {
+		return err
+	}
+
 	// set up ports in config so we dont interfere with an already running daemon
 	stump.VLog("  - tweaking test config to avoid external interference")
 	err = tweakConfig(tdir)
@@ -228,9 +290,20 @@ func TestBinary(bin, version string) error {
 		return err
 	}
 
+	err = preservePlugins(tdir)
+	if err != nil {
+		return fmt.Errorf("error carrying over installed plugins: %s", err)
+	}
+
 	stump.VLog("  - starting up daemon")
-	daemon, err := StartDaemon(tdir, bin)
+	daemon, err := StartDaemon(tdir, bin, checksInclude(checks, "pubsub"))
 	if err != nil {
+		// a plugin that's incompatible with the candidate binary can crash
+		// the daemon before the api ever comes up, so check for that
+		// specifically rather than surfacing the generic timeout below.
+		if pluginErr, ok := checkPluginLoadErrors(tdir, ignorePluginErrors).(*PluginLoadError); ok {
+			return pluginErr
+		}
 		return fmt.Errorf("error starting daemon: %s", err)
 	}
 	defer func() {
@@ -242,40 +315,20 @@ func TestBinary(bin, version string) error {
 		stump.Log("success!")
 	}()
 
-	// test some basic things against the daemon
-	err = testFileAdd(tdir, bin)
-	if err != nil {
-		return err
-	}
-
-	err = testRefsList(tdir, bin)
+	err = checkPluginLoadErrors(tdir, ignorePluginErrors)
 	if err != nil {
 		return err
 	}
 
-	return nil
-}
-
-func beforeVersion(check, cur string) bool {
-	aparts := strings.Split(check[1:], ".")
-	bparts := strings.Split(cur[1:], ".")
-	for i := 0; i < 3; i++ {
-		an, err := strconv.Atoi(aparts[i])
-		if err != nil {
-			return false
-		}
-		bn, err := strconv.Atoi(bparts[i])
+	for _, c := range checks {
+		stump.VLog("  - running check %q", c.Name())
+		err = c.Run(tdir, bin)
 		if err != nil {
-			return false
-		}
-		if bn < an {
-			return true
-		}
-		if bn > an {
-			return false
+			return fmt.Errorf("check %q failed: %s", c.Name(), err)
 		}
 	}
-	return false
+
+	return nil
 }
 
 func testFileAdd(tdir, bin string) error {